@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/jedisct1/go-minisign"
+)
+
+const (
+	// DefaultPrefetchDelay is how long a successfully refreshed source is
+	// considered fresh before it is due for another prefetch.
+	DefaultPrefetchDelay time.Duration = 24 * time.Hour
+
+	// MinimumPrefetchInterval is how soon a source that failed to refresh
+	// is retried, so a flaky link doesn't end up wedged for a full day.
+	MinimumPrefetchInterval time.Duration = 10 * time.Minute
+
+	// downloadTmpSuffix names the in-progress download next to the final
+	// cache file; it only ever holds bytes that have been verified as
+	// coming from the currently expected resource (see downloadInfo).
+	downloadTmpSuffix = ".tmp"
+
+	// downloadInfoSuffix names the small JSON sidecar recording what the
+	// in-progress .tmp download is supposed to add up to, so a later
+	// attempt can tell a genuine resume from a moved/changed resource.
+	downloadInfoSuffix = ".info"
+
+	// validatorsSuffix names the small JSON sidecar recording the ETag
+	// and Last-Modified of the currently cached content, sent back as
+	// If-None-Match / If-Modified-Since on the next fetch.
+	validatorsSuffix = ".etag"
+)
+
+// SourceFormat identifies the encoding of a source's content.
+type SourceFormat int
+
+const (
+	SourceFormatV2 SourceFormat = iota
+)
+
+// Source represents a single remote (and locally cached) list of servers.
+type Source struct {
+	name          string
+	urls          []*url.URL
+	format        SourceFormat
+	in            []byte
+	minisignKey   *minisign.PublicKey
+	cacheFile     string
+	cacheTTL      time.Duration
+	prefetchDelay time.Duration
+	refresh       time.Time
+}
+
+// timeNow is a package-level indirection over time.Now so that tests can
+// pin "now" to a fixed value.
+var timeNow = time.Now
+
+// downloadInfo records the expected final size and validator of an
+// in-progress (possibly partial) download, so a later attempt knows
+// whether resuming from the bytes already on disk still makes sense.
+type downloadInfo struct {
+	Length int64  `json:"length"`
+	ETag   string `json:"etag,omitempty"`
+}
+
+// cacheValidators records the validators returned for the currently
+// cached content, so an unchanged upstream can be detected with a
+// conditional GET instead of a full re-download.
+type cacheValidators struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"last_modified,omitempty"`
+}
+
+// NewSource loads a source from its on-disk cache, refreshing it from
+// urls if the cache is missing, invalid or older than refreshDelay.
+func NewSource(name string, xTransport *XTransport, urls []string, minisignKeyStr string, cacheFile string, formatStr string, refreshDelay time.Duration) (*Source, error) {
+	source := &Source{name: name, urls: []*url.URL{}, cacheFile: cacheFile, cacheTTL: refreshDelay, prefetchDelay: DefaultPrefetchDelay}
+	if formatStr != "v2" {
+		return source, fmt.Errorf("Unsupported source format: [%s]", formatStr)
+	}
+	source.format = SourceFormatV2
+	key, err := minisign.NewPublicKey(minisignKeyStr)
+	if err != nil {
+		return source, fmt.Errorf("Invalid encoded public key: [%v]", err)
+	}
+	source.minisignKey = &key
+	for _, urlStr := range urls {
+		u, err := url.Parse(urlStr)
+		if err != nil {
+			dlog.Warnf("Source [%s]: ignoring invalid URL [%s]: %v", name, urlStr, err)
+			continue
+		}
+		source.urls = append(source.urls, u)
+	}
+
+	now := timeNow()
+	cached, fresh, cacheErr := source.loadCache(now)
+	if cached != nil {
+		source.in = cached
+	}
+	if fresh {
+		if len(source.urls) > 0 {
+			source.refresh = now.Add(source.prefetchDelay)
+		}
+		return source, nil
+	}
+	if len(source.urls) == 0 {
+		return source, cacheErr
+	}
+	return source, source.refreshFromURLs(xTransport, now)
+}
+
+// PrefetchSources refreshes every source whose prefetch delay has
+// elapsed, and returns how long the caller should wait before checking
+// again.
+func PrefetchSources(xTransport *XTransport, sources []*Source) time.Duration {
+	now := timeNow()
+	interval := MinimumPrefetchInterval
+	haveInterval := false
+	for _, source := range sources {
+		if len(source.urls) == 0 {
+			continue
+		}
+		if source.refresh.IsZero() || !now.Before(source.refresh) {
+			if err := source.refreshFromURLs(xTransport, now); err != nil {
+				dlog.Warnf("Source [%s]: %v", source.name, err)
+			}
+		}
+		if d := source.refresh.Sub(now); !haveInterval || d < interval {
+			interval, haveInterval = d, true
+		}
+	}
+	return interval
+}
+
+// loadCache reads and verifies the on-disk cache, returning its content
+// (even if stale, as a fallback) and whether it is still fresh enough
+// that no refresh is needed.
+func (source *Source) loadCache(now time.Time) (bin []byte, fresh bool, err error) {
+	if bin, err = ioutil.ReadFile(source.cacheFile); err != nil {
+		return nil, false, err
+	}
+	var sig []byte
+	if sig, err = ioutil.ReadFile(source.cacheFile + ".minisig"); err != nil {
+		return nil, false, err
+	}
+	if err = source.verifySignature(bin, sig); err != nil {
+		return nil, false, err
+	}
+	fi, err := os.Stat(source.cacheFile)
+	if err != nil {
+		return bin, false, err
+	}
+	return bin, now.Sub(fi.ModTime()) < source.cacheTTL, nil
+}
+
+// refreshFromURLs tries each mirror URL in turn until one yields a
+// signature-verified download, keeping the previously loaded content as
+// a fallback if every mirror fails.
+func (source *Source) refreshFromURLs(xTransport *XTransport, now time.Time) error {
+	var lastErr error
+	for _, u := range source.urls {
+		bin, unchanged, err := source.fetchAndVerify(xTransport, u, now)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if !unchanged {
+			source.in = bin
+		}
+		source.refresh = now.Add(source.prefetchDelay)
+		return nil
+	}
+	source.refresh = now.Add(MinimumPrefetchInterval)
+	return lastErr
+}
+
+// fetchAndVerify downloads the content and its .minisig from u, resuming
+// a previous partial download when possible, and only commits the
+// result to the cache file once the signature checks out. If the server
+// reports the content as unchanged since the last successful fetch, the
+// download and signature verification are skipped entirely.
+func (source *Source) fetchAndVerify(xTransport *XTransport, u *url.URL, now time.Time) (bin []byte, unchanged bool, err error) {
+	validatorsPath := source.cacheFile + validatorsSuffix
+	validators, _ := readCacheValidators(validatorsPath)
+
+	bin, unchanged, err = source.fetchToCache(xTransport, u, source.cacheFile, &validators)
+	if err != nil || unchanged {
+		return nil, unchanged, err
+	}
+	sig, _, err := source.fetchToCache(xTransport, appendSuffix(u, ".minisig"), source.cacheFile+".minisig", nil)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := source.verifySignature(bin, sig); err != nil {
+		return nil, false, err
+	}
+	if err := finalizeDownload(source.cacheFile); err != nil {
+		return nil, false, err
+	}
+	if err := finalizeDownload(source.cacheFile + ".minisig"); err != nil {
+		return nil, false, err
+	}
+	writeCacheValidators(validatorsPath, validators)
+	return bin, false, nil
+}
+
+// fetchToCache downloads u into "<cachePath>.tmp", resuming from the
+// bytes already on disk via a Range request when a previous attempt left
+// some behind, and starting over whenever the server's response shows
+// the resource no longer matches what was partially downloaded.
+//
+// When validators is non-nil and no resume is in progress, it is sent as
+// If-None-Match / If-Modified-Since; a 304 response is reported back as
+// unchanged without touching the cache, while a 200/206 response updates
+// *validators with the new ETag/Last-Modified for the caller to persist
+// once the content has been verified.
+func (source *Source) fetchToCache(xTransport *XTransport, u *url.URL, cachePath string, validators *cacheValidators) (bin []byte, unchanged bool, err error) {
+	tmpPath := cachePath + downloadTmpSuffix
+	infoPath := tmpPath + downloadInfoSuffix
+
+	var offset int64
+	var expected downloadInfo
+	if fi, err := os.Stat(tmpPath); err == nil {
+		if info, ok := readDownloadInfo(infoPath); ok {
+			offset, expected = fi.Size(), info
+		} else {
+			os.Remove(tmpPath)
+		}
+	}
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	} else if validators != nil {
+		if validators.ETag != "" {
+			header.Set("If-None-Match", validators.ETag)
+		}
+		if !validators.LastModified.IsZero() {
+			header.Set("If-Modified-Since", validators.LastModified.UTC().Format(http.TimeFormat))
+		}
+	}
+	resp, err := xTransport.Get(u, header, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, true, nil
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		return nil, false, fmt.Errorf("%s", resp.Status)
+	}
+
+	length, etag, lastModified := responseValidators(resp)
+	resuming := offset > 0 && resp.StatusCode == http.StatusPartialContent &&
+		length == expected.Length && (expected.ETag == "" || etag == "" || etag == expected.ETag)
+	if offset > 0 && !resuming {
+		os.Remove(tmpPath)
+		os.Remove(infoPath)
+		if resp.StatusCode == http.StatusPartialContent {
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			return nil, false, errors.New("Partial response does not match the interrupted download")
+		}
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY
+	if resuming {
+		flags |= os.O_APPEND
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(tmpPath, flags, 0644)
+	if err != nil {
+		return nil, false, err
+	}
+	writeDownloadInfo(infoPath, downloadInfo{Length: length, ETag: etag})
+
+	_, copyErr := io.Copy(f, resp.Body)
+	closeErr := f.Close()
+	if copyErr != nil {
+		return nil, false, copyErr
+	}
+	if closeErr != nil {
+		return nil, false, closeErr
+	}
+
+	bin, err = ioutil.ReadFile(tmpPath)
+	if err != nil {
+		return nil, false, err
+	}
+	os.Remove(infoPath)
+	if validators != nil {
+		*validators = cacheValidators{ETag: etag, LastModified: lastModified}
+	}
+	return bin, false, nil
+}
+
+// finalizeDownload promotes a fully verified "<path>.tmp" to path.
+func finalizeDownload(path string) error {
+	return os.Rename(path+downloadTmpSuffix, path)
+}
+
+// responseValidators extracts the total resource length (following
+// Content-Range on a 206, Content-Length otherwise), the ETag and the
+// Last-Modified time, if any, from a download response.
+func responseValidators(resp *http.Response) (length int64, etag string, lastModified time.Time) {
+	length = resp.ContentLength
+	if resp.StatusCode == http.StatusPartialContent {
+		if cr := resp.Header.Get("Content-Range"); cr != "" {
+			if i := strings.LastIndex(cr, "/"); i >= 0 {
+				if total, err := strconv.ParseInt(cr[i+1:], 10, 64); err == nil {
+					length = total
+				}
+			}
+		}
+	}
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		if t, err := http.ParseTime(lm); err == nil {
+			lastModified = t
+		}
+	}
+	return length, resp.Header.Get("ETag"), lastModified
+}
+
+// readCacheValidators loads the ETag/Last-Modified recorded for the
+// currently cached content, if any.
+func readCacheValidators(path string) (cacheValidators, bool) {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cacheValidators{}, false
+	}
+	var validators cacheValidators
+	if err := json.Unmarshal(bin, &validators); err != nil {
+		return cacheValidators{}, false
+	}
+	return validators, true
+}
+
+// writeCacheValidators persists validators next to the cache file, or
+// removes the sidecar if the upstream didn't provide any.
+func writeCacheValidators(path string, validators cacheValidators) {
+	if validators.ETag == "" && validators.LastModified.IsZero() {
+		os.Remove(path)
+		return
+	}
+	if bin, err := json.Marshal(validators); err == nil {
+		_ = ioutil.WriteFile(path, bin, 0644)
+	}
+}
+
+func readDownloadInfo(path string) (downloadInfo, bool) {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil {
+		return downloadInfo{}, false
+	}
+	var info downloadInfo
+	if err := json.Unmarshal(bin, &info); err != nil {
+		return downloadInfo{}, false
+	}
+	return info, true
+}
+
+func writeDownloadInfo(path string, info downloadInfo) {
+	if bin, err := json.Marshal(info); err == nil {
+		_ = ioutil.WriteFile(path, bin, 0644)
+	}
+}
+
+// appendSuffix clones u with suffix appended to its path, used to derive
+// a .minisig URL from a content URL.
+func appendSuffix(u *url.URL, suffix string) *url.URL {
+	clone := *u
+	clone.Path += suffix
+	if clone.RawPath != "" {
+		clone.RawPath += suffix
+	}
+	return &clone
+}
+
+// verifySignature checks bin against its detached minisign signature sig.
+func (source *Source) verifySignature(bin, sig []byte) error {
+	signature, err := minisign.DecodeSignature(string(sig))
+	if err != nil {
+		return fmt.Errorf("Invalid signature: %v", err)
+	}
+	ok, err := source.minisignKey.Verify(bin, signature)
+	if err != nil {
+		return fmt.Errorf("Invalid signature: %v", err)
+	}
+	if !ok {
+		return errors.New("Invalid signature")
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -17,12 +18,28 @@ import (
 	"github.com/powerman/check"
 )
 
+// parseRangeOffset extracts N from a "bytes=N-" Range header.
+func parseRangeOffset(rangeHeader string) (int64, bool) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(rangeHeader, prefix) {
+		return 0, false
+	}
+	spec := strings.TrimSuffix(strings.TrimPrefix(rangeHeader, prefix), "-")
+	off, err := strconv.ParseInt(spec, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return off, true
+}
+
 type SourceFixture struct {
-	suffix  string
-	content []byte
-	length  string // HTTP Content-Length header
-	perms   os.FileMode
-	mtime   time.Time
+	suffix       string
+	content      []byte
+	length       string // HTTP Content-Length header
+	perms        os.FileMode
+	mtime        time.Time
+	etag         string    // HTTP ETag header, honored as If-None-Match by makeTestServer
+	lastModified time.Time // HTTP Last-Modified header, honored as If-Modified-Since by makeTestServer
 }
 type SourceTestState uint8
 
@@ -38,6 +55,7 @@ const (
 	TestStateOpenErr                           // I/O error on opening files
 	TestStateOpenSigErr                        // I/O error on opening .minisig
 	TestStatePathErr                           // unparseable path to files (download only)
+	TestStateResumable                         // first request truncated partway, second resumes via Range (download only)
 )
 
 type SourceTestData struct {
@@ -155,6 +173,13 @@ func loadFixtures(t *testing.T, d *SourceTestData) {
 			}
 		}
 	}
+	d.fixtures[TestStateResumable] = map[string]SourceFixture{}
+	for _, source := range d.sources {
+		for _, suffix := range [...]string{"", ".minisig"} {
+			file := source + suffix
+			d.fixtures[TestStateResumable][file] = d.fixtures[TestStateCorrect][file]
+		}
+	}
 }
 
 func makeTempDir(t *testing.T, d *SourceTestData) {
@@ -177,6 +202,34 @@ func makeTestServer(t *testing.T, d *SourceTestData) {
 				w.Header().Set("Content-Length", fixture.length) // client will return unexpected EOF
 			}
 			data = fixture.content
+			if fixture.etag != "" {
+				w.Header().Set("ETag", fixture.etag)
+			}
+			if !fixture.lastModified.IsZero() {
+				w.Header().Set("Last-Modified", fixture.lastModified.UTC().Format(http.TimeFormat))
+			}
+			if (fixture.etag != "" && r.Header.Get("If-None-Match") == fixture.etag) ||
+				(!fixture.lastModified.IsZero() && r.Header.Get("If-Modified-Since") == fixture.lastModified.UTC().Format(http.TimeFormat)) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			if SourceTestState(state) == TestStateResumable && !strings.HasSuffix(pathParts[1], ".minisig") {
+				if off, ok := parseRangeOffset(r.Header.Get("Range")); ok && off <= int64(len(data)) {
+					total := int64(len(data))
+					w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", off, total-1, total))
+					w.Header().Set("Content-Length", strconv.FormatInt(total-off, 10))
+					w.WriteHeader(http.StatusPartialContent)
+					data = data[off:]
+				} else {
+					// Simulate a connection that dies partway through the
+					// first attempt: declare the real length but only
+					// ever write half of it. The .minisig fetch is left
+					// untouched so it only ever happens once the content
+					// itself has fully resumed.
+					w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+					data = data[:len(data)/2]
+				}
+			}
 		}
 		if data != nil {
 			if _, err := w.Write(data); err != nil {
@@ -400,4 +453,116 @@ func TestPrefetchSources(t *testing.T) {
 	}
 }
 
-func TestMain(m *testing.M) { check.TestMain(m) }
\ No newline at end of file
+// TestResumableSourceDownload exercises a first attempt that is truncated
+// partway through, followed by a second attempt that resumes from the
+// bytes already on disk via a Range request and ends up with a fully
+// verified source.
+func TestResumableSourceDownload(t *testing.T) {
+	teardown, d := setupSourceTest(t)
+	defer teardown()
+	c := check.T(t)
+
+	source := d.sources[0]
+	path := "/" + strconv.FormatUint(uint64(TestStateResumable), 10) + "/" + source
+	cachePath := filepath.Join(d.tempDir, "resumable")
+	u := d.server.URL + path
+
+	// First attempt: truncated partway through, no prior .tmp on disk.
+	got, err := NewSource("resumable", d.xTransport, []string{u}, d.keyStr, cachePath, "v2", DefaultPrefetchDelay*3)
+	c.Match(err, "unexpected EOF", "Expected a truncated first attempt")
+	c.Nil(got.in, "No content should have been accepted from a truncated download")
+
+	tmpBin, tmpErr := ioutil.ReadFile(cachePath + downloadTmpSuffix)
+	c.Nil(tmpErr, "Partial bytes should have been kept on disk")
+	full := d.fixtures[TestStateResumable][source].content
+	c.DeepEqual(tmpBin, full[:len(full)/2], "Unexpected partial content on disk")
+	c.DeepEqual(d.reqActual, map[string]uint{path: 1}, "First attempt should only fetch the content, not the signature")
+	d.reqActual = map[string]uint{}
+
+	// Second attempt: resumes from the bytes already on disk, then fetches
+	// and verifies the signature.
+	got, err = NewSource("resumable", d.xTransport, []string{u}, d.keyStr, cachePath, "v2", DefaultPrefetchDelay*3)
+	c.Nil(err, "Unexpected error resuming the download")
+	c.DeepEqual(got.in, full, "Unexpected content after resuming")
+	c.DeepEqual(d.reqActual, map[string]uint{path: 1, path + ".minisig": 1}, "Unexpected HTTP request log")
+
+	checkSourceCache(c, cachePath, []SourceFixture{d.fixtures[TestStateResumable][source], d.fixtures[TestStateResumable][source+".minisig"]})
+	if _, err := os.Stat(cachePath + downloadTmpSuffix); !os.IsNotExist(err) {
+		t.Fatalf("Temporary download file should have been promoted to the cache file")
+	}
+}
+
+// TestConditionalSourceFetch exercises If-None-Match / If-Modified-Since
+// handling on a stale cache: a 304 keeps the cache untouched, a 200 with
+// a new ETag rewrites it and the validators sidecar, and a plain 200
+// without any validator still works as before.
+func TestConditionalSourceFetch(t *testing.T) {
+	teardown, d := setupSourceTest(t)
+	defer teardown()
+	source := d.sources[0]
+	path := "/" + strconv.FormatUint(uint64(TestStateCorrect), 10) + "/" + source
+
+	t.Run("304 Not Modified keeps the existing cache", func(t *testing.T) {
+		c := check.T(t)
+		cachePath := filepath.Join(d.tempDir, "etag-304")
+		fx, sigFx := d.fixtures[TestStateCorrect][source], d.fixtures[TestStateCorrect][source+".minisig"]
+		fx.etag, fx.mtime, sigFx.mtime = `"v1"`, d.timeOld, d.timeOld
+		d.fixtures[TestStateCorrect][source] = fx
+		writeSourceCache(t, cachePath, []SourceFixture{fx, sigFx})
+		if err := ioutil.WriteFile(cachePath+validatorsSuffix, []byte(`{"etag":"\"v1\""}`), 0644); err != nil {
+			t.Fatalf("Unable to write validators sidecar: %v", err)
+		}
+		d.reqActual = map[string]uint{}
+
+		got, err := NewSource("etag-304", d.xTransport, []string{d.server.URL + path}, d.keyStr, cachePath, "v2", DefaultPrefetchDelay*3)
+		c.Nil(err, "Unexpected error")
+		c.DeepEqual(got.in, fx.content, "Unexpected content")
+		c.DeepEqual(d.reqActual, map[string]uint{path: 1}, "A 304 should only need the conditional content request")
+		checkSourceCache(c, cachePath, []SourceFixture{fx, sigFx})
+	})
+
+	t.Run("200 with a new ETag rewrites the cache and sidecar", func(t *testing.T) {
+		c := check.T(t)
+		cachePath := filepath.Join(d.tempDir, "etag-200-new")
+		fx, sigFx := d.fixtures[TestStateCorrect][source], d.fixtures[TestStateCorrect][source+".minisig"]
+		fx.etag = `"v2"`
+		d.fixtures[TestStateCorrect][source] = fx
+		stale, staleSig := fx, sigFx
+		stale.mtime, staleSig.mtime = d.timeOld, d.timeOld
+		writeSourceCache(t, cachePath, []SourceFixture{stale, staleSig})
+		if err := ioutil.WriteFile(cachePath+validatorsSuffix, []byte(`{"etag":"\"v1\""}`), 0644); err != nil {
+			t.Fatalf("Unable to write validators sidecar: %v", err)
+		}
+		d.reqActual = map[string]uint{}
+
+		got, err := NewSource("etag-200-new", d.xTransport, []string{d.server.URL + path}, d.keyStr, cachePath, "v2", DefaultPrefetchDelay*3)
+		c.Nil(err, "Unexpected error")
+		c.DeepEqual(got.in, fx.content, "Unexpected content")
+		c.DeepEqual(d.reqActual, map[string]uint{path: 1, path + ".minisig": 1}, "Unexpected HTTP request log")
+		checkSourceCache(c, cachePath, []SourceFixture{fx, sigFx})
+
+		validators, ok := readCacheValidators(cachePath + validatorsSuffix)
+		c.DeepEqual(ok, true, "Expected a validators sidecar to have been written")
+		c.DeepEqual(validators.ETag, fx.etag, "Unexpected recorded ETag")
+	})
+
+	t.Run("200 without a validator behaves like a normal fetch", func(t *testing.T) {
+		c := check.T(t)
+		cachePath := filepath.Join(d.tempDir, "etag-200-plain")
+		fx, sigFx := d.fixtures[TestStateCorrect][source], d.fixtures[TestStateCorrect][source+".minisig"]
+		fx.etag = ""
+		d.fixtures[TestStateCorrect][source] = fx
+		d.reqActual = map[string]uint{}
+
+		got, err := NewSource("etag-200-plain", d.xTransport, []string{d.server.URL + path}, d.keyStr, cachePath, "v2", DefaultPrefetchDelay*3)
+		c.Nil(err, "Unexpected error")
+		c.DeepEqual(got.in, fx.content, "Unexpected content")
+		c.DeepEqual(d.reqActual, map[string]uint{path: 1, path + ".minisig": 1}, "Unexpected HTTP request log")
+		checkSourceCache(c, cachePath, []SourceFixture{fx, sigFx})
+		if _, err := os.Stat(cachePath + validatorsSuffix); !os.IsNotExist(err) {
+			t.Fatalf("No validators sidecar should have been written without an ETag or Last-Modified")
+		}
+	})
+}
+
+func TestMain(m *testing.M) { check.TestMain(m) }
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// XTransport bundles the HTTP client and transport used for all outgoing
+// fetches (source lists, relays, stamps, ...) so that timeouts and
+// connection reuse are configured consistently in a single place.
+type XTransport struct {
+	transport *http.Transport
+	client    *http.Client
+	keepAlive time.Duration
+	timeout   time.Duration
+}
+
+// NewXTransport creates an XTransport with sane defaults and an already
+// built underlying http.Client.
+func NewXTransport() *XTransport {
+	xTransport := &XTransport{
+		keepAlive: 5 * time.Second,
+		timeout:   30 * time.Second,
+	}
+	xTransport.rebuildTransport()
+	return xTransport
+}
+
+// rebuildTransport (re)creates the http.Transport/http.Client pair, for
+// instance after a configuration change affecting dialing or proxying.
+func (xTransport *XTransport) rebuildTransport() {
+	dialer := &net.Dialer{KeepAlive: xTransport.keepAlive}
+	transport := &http.Transport{
+		DisableKeepAlives:  false,
+		DialContext:        dialer.DialContext,
+		MaxIdleConns:       1,
+		IdleConnTimeout:    xTransport.keepAlive,
+		DisableCompression: true,
+	}
+	xTransport.transport = transport
+	xTransport.client = &http.Client{Transport: transport, Timeout: xTransport.timeout}
+}
+
+// Get issues an HTTP GET to url, with the given extra request headers
+// (used to carry Range / If-None-Match / If-Modified-Since) and an
+// optional per-call timeout override. The caller owns the response body
+// and must close it.
+func (xTransport *XTransport) Get(u *url.URL, header http.Header, timeout time.Duration) (*http.Response, error) {
+	client := xTransport.client
+	if timeout > 0 {
+		overridden := *client
+		overridden.Timeout = timeout
+		client = &overridden
+	}
+	req := &http.Request{Method: "GET", URL: u, Header: header}
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	return client.Do(req)
+}